@@ -1,22 +1,86 @@
-// Retrieves and verifies an AWS Instance Identity Document using a pinned certificate.
+// Package awsid retrieves and verifies AWS EC2 instance identity documents
+// against a pinned certificate.
 // See https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
-package main
+package awsid
 
 import (
+	"context"
+	"crypto"
+	"crypto/dsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/fullsailor/pkcs7"
+	"go.mozilla.org/pkcs7"
 )
 
 const (
-	sigURL = "http://169.254.169.254/latest/dynamic/instance-identity/pkcs7"
+	defaultMetadataBaseURL = "http://169.254.169.254"
+
+	pkcs7Path     = "/latest/dynamic/instance-identity/pkcs7"
+	rsa2048Path   = "/latest/dynamic/instance-identity/rsa2048"
+	documentPath  = "/latest/dynamic/instance-identity/document"
+	signaturePath = "/latest/dynamic/instance-identity/signature"
 )
 
+// SigAlgo identifies the signature algorithm an AWS region signs its
+// instance identity documents with.
+type SigAlgo string
+
+// Signature algorithms used across AWS partitions.
+const (
+	// SigAlgoDSASHA1 is used by the pkcs7 endpoint.
+	SigAlgoDSASHA1 SigAlgo = "dsa-sha1"
+
+	// SigAlgoRSA2048SHA256 is used by the rsa2048 endpoint and by the
+	// detached signature at the signature endpoint.
+	SigAlgoRSA2048SHA256 SigAlgo = "rsa-2048-sha256"
+)
+
+// SignatureFormat selects which signed representation of the instance
+// identity document a Verifier fetches and how it verifies it.
+type SignatureFormat int
+
+const (
+	// FormatPKCS7DSA verifies the PKCS7 envelope at the pkcs7 endpoint,
+	// signed with DSA-SHA1. This is the zero value and AWS's original
+	// format, but modern Go and OpenSSL builds increasingly refuse to
+	// verify DSA-SHA1 signatures at all.
+	FormatPKCS7DSA SignatureFormat = iota
+
+	// FormatPKCS7RSA2048 verifies the PKCS7 envelope at the rsa2048
+	// endpoint, signed with RSA-2048/SHA-256.
+	FormatPKCS7RSA2048
+
+	// FormatDetachedRSA2048 verifies the plain document at the document
+	// endpoint against the detached RSA-2048/SHA-256 signature at the
+	// signature endpoint.
+	FormatDetachedRSA2048
+)
+
+// sigAlgo returns the SigAlgo a CertificateStore lookup should use to find
+// the certificate for documents signed in this format.
+func (f SignatureFormat) sigAlgo() SigAlgo {
+	if f == FormatPKCS7DSA {
+		return SigAlgoDSASHA1
+	}
+	return SigAlgoRSA2048SHA256
+}
+
 // This cert is self-signed using DSA with SHA1. It was retrieved from Amazon
 // over TLS from both an ordinary internet connection and Tor. The TLS
 // certificate presented by docs.aws.amazon.com at the time was:
@@ -42,46 +106,349 @@ vSeDCOUMYQR7R9LINYwouHIziqQYMAkGByqGSM44BAMDLwAwLAIUWXBlk40xTwSw
 -----END CERTIFICATE-----
 `
 
-// extracts a PEM-encoded X509 certificate.
-func decodeCertificate(pemCert []byte) (*x509.Certificate, error) {
-	block, _ := pem.Decode(pemCert)
-	if block == nil || block.Type != "CERTIFICATE" {
-		return nil, fmt.Errorf("could not decode PEM block type %s", block.Type)
-	}
+// commercialRegions lists the AWS commercial-partition regions documented
+// to sign their identity documents with amazonCertPem. GovCloud and China
+// partitions use different certificates that AWS does not publish in the
+// same place; callers operating there must register their own certificate
+// with RegisterRegionCertificate.
+var commercialRegions = []string{
+	"us-east-1", "us-east-2", "us-west-1", "us-west-2",
+	"af-south-1",
+	"ap-east-1", "ap-south-1", "ap-northeast-1", "ap-northeast-2", "ap-northeast-3",
+	"ap-southeast-1", "ap-southeast-2",
+	"ca-central-1",
+	"eu-central-1", "eu-west-1", "eu-west-2", "eu-west-3", "eu-north-1", "eu-south-1",
+	"me-south-1",
+	"sa-east-1",
+}
 
-	cert, err := x509.ParseCertificate(block.Bytes)
+// certKey identifies a (region, algorithm) pair in a CertificateStore.
+type certKey struct {
+	region string
+	algo   SigAlgo
+}
+
+// CertificateStore holds the signing certificates AWS uses per region and
+// signature algorithm. The zero value is not usable; construct one with
+// NewCertificateStore.
+type CertificateStore struct {
+	mu    sync.RWMutex
+	certs map[certKey]*x509.Certificate
+}
+
+// NewCertificateStore returns a CertificateStore seeded with the
+// documented certificate for AWS's commercial-partition regions. It panics
+// if the embedded certificate cannot be parsed, since that indicates a bug
+// in this package rather than a condition callers can recover from.
+func NewCertificateStore() *CertificateStore {
+	s := &CertificateStore{certs: make(map[certKey]*x509.Certificate)}
+
+	cert, err := decodeCertificate([]byte(amazonCertPem))
 	if err != nil {
-		return nil, err
+		panic(fmt.Sprintf("awsid: embedded Amazon certificate is invalid: %v", err))
+	}
+	for _, region := range commercialRegions {
+		s.certs[certKey{region: region, algo: SigAlgoDSASHA1}] = cert
 	}
 
-	// should be self-signed, so at least check that
-	err = cert.CheckSignatureFrom(cert)
+	return s
+}
+
+// Register adds or replaces the certificate used to verify documents signed
+// by region using algo. pem must contain a single self-signed PEM
+// certificate. Use this to add certificates for isolated partitions (AWS
+// GovCloud, China, Outposts with local endpoints) that are not seeded by
+// default, and to add RSA-2048 certificates, which this package does not
+// bundle for any region.
+func (s *CertificateStore) Register(region string, algo SigAlgo, pem []byte) error {
+	cert, err := decodeCertificate(pem)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't verify self-signed AWS region cert: %v", err)
+		return err
 	}
 
-	return cert, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs[certKey{region: region, algo: algo}] = cert
+	return nil
 }
 
-// formats and decodes a stripped PKCS7 document.
-func decodePKCS7Response(resp []byte) (*pkcs7.PKCS7, error) {
-	p7Pem := fmt.Sprintf("-----BEGIN PKCS7-----\n%s\n-----END PKCS7-----", resp)
-	block, _ := pem.Decode([]byte(p7Pem))
-	if block == nil || block.Type != "PKCS7" {
-		return nil, fmt.Errorf("could not decode PEM block type %s", block.Type)
+// Lookup returns the certificate registered for region and algo, if any.
+func (s *CertificateStore) Lookup(region string, algo SigAlgo) (*x509.Certificate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert, ok := s.certs[certKey{region: region, algo: algo}]
+	return cert, ok
+}
+
+// defaultCertificateStore backs the package-level RegisterRegionCertificate
+// and the CertificateStore newly constructed Verifiers use.
+var defaultCertificateStore = NewCertificateStore()
+
+// RegisterRegionCertificate adds region's certificate for algo to the
+// default certificate store used by new Verifiers. Callers in isolated
+// partitions (GovCloud, China, local Outposts) should call this with their
+// own certificate before verifying documents from those regions.
+func RegisterRegionCertificate(region string, algo SigAlgo, pem []byte) error {
+	return defaultCertificateStore.Register(region, algo, pem)
+}
+
+// IdentityDocument is the parsed form of the JSON document AWS publishes at
+// /latest/dynamic/instance-identity/document, describing the instance the
+// caller is running on.
+type IdentityDocument struct {
+	AccountID               string    `json:"accountId"`
+	InstanceID              string    `json:"instanceId"`
+	Region                  string    `json:"region"`
+	AvailabilityZone        string    `json:"availabilityZone"`
+	InstanceType            string    `json:"instanceType"`
+	ImageID                 string    `json:"imageId"`
+	PendingTime             time.Time `json:"pendingTime"`
+	Architecture            string    `json:"architecture"`
+	PrivateIP               string    `json:"privateIp"`
+	KernelID                string    `json:"kernelId"`
+	RamdiskID               string    `json:"ramdiskId"`
+	BillingProducts         []string  `json:"billingProducts"`
+	DevpayProductCodes      []string  `json:"devpayProductCodes"`
+	MarketplaceProductCodes []string  `json:"marketplaceProductCodes"`
+	Version                 string    `json:"version"`
+}
+
+// Policy constrains which identity documents a Verifier accepts, checked
+// after signature verification succeeds. An empty allowlist field (nil or
+// zero length) is not enforced. Policy is read-only once in use; build a
+// new one rather than mutating a shared instance concurrently.
+type Policy struct {
+	// AccountIDs, if non-empty, lists the only account IDs a document may
+	// claim.
+	AccountIDs []string
+
+	// Regions, if non-empty, lists the only regions a document may claim.
+	Regions []string
+
+	// InstanceTypes, if non-empty, lists the only instance types a
+	// document may claim.
+	InstanceTypes []string
+
+	// ImageIDs, if non-empty, lists the only AMI IDs a document may claim.
+	ImageIDs []string
+
+	// MaxPendingAge, if non-zero, rejects documents whose pendingTime is
+	// older than this, analogous to JWT leeway.
+	MaxPendingAge time.Duration
+
+	// InstanceIDAllowlist, if non-empty, lists the only instance IDs a
+	// document may claim.
+	InstanceIDAllowlist []string
+
+	// InstanceIDDenylist, if non-empty, rejects documents claiming any of
+	// these instance IDs, regardless of InstanceIDAllowlist.
+	InstanceIDDenylist []string
+}
+
+// PolicyError reports that a document, though validly signed, violated a
+// Policy constraint.
+type PolicyError struct {
+	// Field names the Policy constraint that was violated, e.g.
+	// "AccountID", "Region", "InstanceType", "ImageID", "InstanceID", or
+	// "PendingTime".
+	Field string
+
+	// Value is the offending value the document claimed.
+	Value string
+
+	// Reason describes why Value was rejected.
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("awsid: policy violation on %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// Check evaluates doc against p, returning the first violated constraint,
+// or nil if doc satisfies all of them. A nil Policy accepts every document.
+func (p *Policy) Check(doc *IdentityDocument) *PolicyError {
+	if p == nil {
+		return nil
 	}
 
-	p7, err := pkcs7.Parse(block.Bytes)
+	if len(p.AccountIDs) > 0 && !stringsContain(p.AccountIDs, doc.AccountID) {
+		return &PolicyError{Field: "AccountID", Value: doc.AccountID, Reason: "account ID is not allowed"}
+	}
+	if len(p.Regions) > 0 && !stringsContain(p.Regions, doc.Region) {
+		return &PolicyError{Field: "Region", Value: doc.Region, Reason: "region is not allowed"}
+	}
+	if len(p.InstanceTypes) > 0 && !stringsContain(p.InstanceTypes, doc.InstanceType) {
+		return &PolicyError{Field: "InstanceType", Value: doc.InstanceType, Reason: "instance type is not allowed"}
+	}
+	if len(p.ImageIDs) > 0 && !stringsContain(p.ImageIDs, doc.ImageID) {
+		return &PolicyError{Field: "ImageID", Value: doc.ImageID, Reason: "image ID is not allowed"}
+	}
+	if len(p.InstanceIDDenylist) > 0 && stringsContain(p.InstanceIDDenylist, doc.InstanceID) {
+		return &PolicyError{Field: "InstanceID", Value: doc.InstanceID, Reason: "instance ID is denylisted"}
+	}
+	if len(p.InstanceIDAllowlist) > 0 && !stringsContain(p.InstanceIDAllowlist, doc.InstanceID) {
+		return &PolicyError{Field: "InstanceID", Value: doc.InstanceID, Reason: "instance ID is not allowed"}
+	}
+	if p.MaxPendingAge > 0 {
+		if age := time.Since(doc.PendingTime); age > p.MaxPendingAge {
+			return &PolicyError{
+				Field:  "PendingTime",
+				Value:  doc.PendingTime.Format(time.RFC3339),
+				Reason: fmt.Sprintf("document is %s old, exceeds max age %s", age, p.MaxPendingAge),
+			}
+		}
+	}
+
+	return nil
+}
+
+func stringsContain(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// IMDSMode selects how a Verifier authenticates to the instance metadata
+// service when fetching a document.
+type IMDSMode int
+
+const (
+	// IMDSAuto tries to obtain an IMDSv2 session token and use it, falling
+	// back to unauthenticated IMDSv1 requests if the token request fails.
+	// This is the zero value.
+	IMDSAuto IMDSMode = iota
+
+	// IMDSV2Only requires an IMDSv2 session token; Fetch fails if one
+	// cannot be obtained. Use this against instances configured with
+	// HttpTokens=required.
+	IMDSV2Only
+
+	// IMDSV1Only never requests a session token.
+	IMDSV1Only
+)
+
+const (
+	tokenPath       = "/latest/api/token"
+	tokenTTLHeader  = "X-aws-ec2-metadata-token-ttl-seconds"
+	tokenHeader     = "X-aws-ec2-metadata-token"
+	tokenTTLSeconds = 21600
+)
+
+// Verifier fetches and verifies AWS instance identity documents.
+type Verifier struct {
+	// Certs is consulted to select the certificate a document is verified
+	// against, based on the region the document claims to be from.
+	Certs *CertificateStore
+
+	// Format selects which signed representation of the document Fetch
+	// retrieves and how it is verified. Defaults to FormatPKCS7DSA.
+	Format SignatureFormat
+
+	// BaseURL is the instance metadata base URL Fetch resolves its
+	// endpoints against. Defaults to the standard link-local address.
+	// Override this in tests, or for SSM hybrid agents whose metadata
+	// endpoint differs.
+	BaseURL string
+
+	// IMDSMode controls whether Fetch authenticates to instance metadata
+	// with an IMDSv2 session token. Defaults to IMDSAuto.
+	IMDSMode IMDSMode
+
+	// HTTPClient is used for all metadata requests. Defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Policy, if set, is checked against every document that passes
+	// signature verification. A document that violates it is rejected with
+	// a *PolicyError.
+	Policy *Policy
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewVerifier returns a Verifier that checks signatures against the default
+// CertificateStore of documented AWS region certificates.
+func NewVerifier() (*Verifier, error) {
+	return &Verifier{Certs: defaultCertificateStore}, nil
+}
+
+func (v *Verifier) baseURL() string {
+	if v.BaseURL != "" {
+		return v.BaseURL
+	}
+	return defaultMetadataBaseURL
+}
+
+func (v *Verifier) httpClient() *http.Client {
+	if v.HTTPClient != nil {
+		return v.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// imdsToken returns a cached or freshly requested IMDSv2 session token.
+func (v *Verifier) imdsToken(ctx context.Context) (string, error) {
+	v.tokenMu.Lock()
+	defer v.tokenMu.Unlock()
+
+	if v.token != "" && time.Now().Before(v.tokenExpiry) {
+		return v.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, v.baseURL()+tokenPath, nil)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	req.Header.Set(tokenTTLHeader, strconv.Itoa(tokenTTLSeconds))
 
-	return p7, nil
+	resp, err := v.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("IMDSv2 token request failed: %s", resp.Status)
+	}
+
+	v.token = string(body)
+	v.tokenExpiry = time.Now().Add(tokenTTLSeconds * time.Second)
+	return v.token, nil
 }
 
-// returns body of a document specified by URL path.
-func fetchURL(path string) ([]byte, error) {
-	resp, err := http.Get(path)
+// fetchURL returns the body of a document specified by URL, attaching an
+// IMDSv2 session token per v.IMDSMode.
+func (v *Verifier) fetchURL(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.IMDSMode {
+	case IMDSV1Only:
+		// no session token
+	case IMDSV2Only:
+		token, err := v.imdsToken(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not get IMDSv2 token: %v", err)
+		}
+		req.Header.Set(tokenHeader, token)
+	default: // IMDSAuto
+		if token, err := v.imdsToken(ctx); err == nil {
+			req.Header.Set(tokenHeader, token)
+		}
+	}
+
+	resp, err := v.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -90,36 +457,280 @@ func fetchURL(path string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata request to %s failed: %s", url, resp.Status)
+	}
 	return body, nil
 }
 
-func main() {
-	// load the Amazon certificate
-	cert, err := decodeCertificate([]byte(amazonCertPem))
+// Fetch retrieves the signed identity document from the instance metadata
+// service, in the representation selected by v.Format, and verifies it.
+func (v *Verifier) Fetch(ctx context.Context) (*IdentityDocument, error) {
+	switch v.Format {
+	case FormatDetachedRSA2048:
+		document, err := v.fetchURL(ctx, v.baseURL()+documentPath)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := v.fetchURL(ctx, v.baseURL()+signaturePath)
+		if err != nil {
+			return nil, err
+		}
+		return v.VerifyDetachedRSA2048(document, signature)
+	case FormatPKCS7RSA2048:
+		blob, err := v.fetchURL(ctx, v.baseURL()+rsa2048Path)
+		if err != nil {
+			return nil, err
+		}
+		return v.VerifyPKCS7(blob)
+	default:
+		blob, err := v.fetchURL(ctx, v.baseURL()+pkcs7Path)
+		if err != nil {
+			return nil, err
+		}
+		return v.VerifyPKCS7(blob)
+	}
+}
+
+// VerifyPKCS7 verifies a PEM-stripped PKCS7 blob, as returned by the pkcs7
+// or rsa2048 metadata endpoints, and returns the identity document it
+// contains. Which certificate is looked up is determined by v.Format.
+func (v *Verifier) VerifyPKCS7(blob []byte) (*IdentityDocument, error) {
+	sig, err := decodePKCS7Response(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signed content tells us which region's certificate to check
+	// against; this is only a peek, and carries no trust until the
+	// signature below is verified with the certificate it names.
+	var unverified IdentityDocument
+	if err := json.Unmarshal(sig.Content, &unverified); err != nil {
+		return nil, fmt.Errorf("could not parse identity document: %v", err)
+	}
+
+	cert, ok := v.Certs.Lookup(unverified.Region, v.Format.sigAlgo())
+	if !ok {
+		return nil, fmt.Errorf("no certificate registered for region %q", unverified.Region)
+	}
+
+	// No matter what was in the PKCS7 blob, we only use the certificate we
+	// looked up for the document's claimed region.
+	sig.Certificates = []*x509.Certificate{cert}
+
+	// go.mozilla.org/pkcs7's Verify ultimately checks each SignerInfo with
+	// (*x509.Certificate).CheckSignature, which, like CheckSignatureFrom,
+	// does not implement DSA. AWS's default pkcs7 endpoint signs with
+	// DSA-SHA1, so that case is verified by hand instead.
+	if _, ok := cert.PublicKey.(*dsa.PublicKey); ok {
+		if err := verifyDSASignerInfos(sig); err != nil {
+			return nil, err
+		}
+	} else if err := sig.Verify(); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkPolicy(&unverified); err != nil {
+		return nil, err
+	}
+	return &unverified, nil
+}
+
+// VerifyDetachedRSA2048 verifies a plain identity document, as returned by
+// the document metadata endpoint, against its detached RSA-2048/SHA-256
+// signature from the signature metadata endpoint.
+func (v *Verifier) VerifyDetachedRSA2048(document, signature []byte) (*IdentityDocument, error) {
+	var doc IdentityDocument
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse identity document: %v", err)
+	}
+
+	cert, ok := v.Certs.Lookup(doc.Region, SigAlgoRSA2048SHA256)
+	if !ok {
+		return nil, fmt.Errorf("no certificate registered for region %q", doc.Region)
+	}
+
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("region %q certificate is not an RSA key", doc.Region)
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(signature)), ""))
 	if err != nil {
-		log.Fatalf("could not decode Amazon cert: %v\n", err)
+		return nil, fmt.Errorf("could not decode detached signature: %v", err)
+	}
+
+	hashed := sha256.Sum256(document)
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sigBytes); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %v", err)
+	}
+
+	if err := v.checkPolicy(&doc); err != nil {
+		return nil, err
 	}
+	return &doc, nil
+}
 
-	// retrieve signed document
-	document, err := fetchURL(sigURL)
+// checkPolicy enforces v.Policy against an already signature-verified
+// document, if a Policy is set.
+func (v *Verifier) checkPolicy(doc *IdentityDocument) error {
+	if v.Policy == nil {
+		return nil
+	}
+	if perr := v.Policy.Check(doc); perr != nil {
+		return perr
+	}
+	return nil
+}
+
+// decodeCertificate extracts a PEM-encoded X509 certificate.
+func decodeCertificate(pemCert []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(pemCert)
+	if block == nil {
+		return nil, fmt.Errorf("could not decode PEM block")
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("could not decode PEM block type %s", block.Type)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// verify signature
-	sig, err := decodePKCS7Response(document)
+	// should be self-signed, so at least check that. crypto/x509 does not
+	// implement DSA signature verification (DSAWithSHA1 is unsupported),
+	// which AWS's own region certificate uses, so that case is checked by
+	// hand the same way go.mozilla.org/pkcs7 verifies DSA SignerInfos.
+	if cert.SignatureAlgorithm == x509.DSAWithSHA1 {
+		err = checkDSASelfSignature(cert)
+	} else {
+		err = cert.CheckSignatureFrom(cert)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("couldn't verify self-signed AWS region cert: %v", err)
 	}
 
-	// No matter what was in the PKCS7 blob, we only use the supplied
-	// certificate.
-	sig.Certificates = []*x509.Certificate{cert}
-	err = sig.Verify()
+	return cert, nil
+}
+
+// dsaSignature is the ASN.1 structure of a DSA signature, as used in a
+// certificate's Signature field.
+type dsaSignature struct {
+	R, S *big.Int
+}
+
+// checkDSASelfSignature verifies cert's signature against its own DSA
+// public key, since crypto/x509 refuses to do this itself.
+func checkDSASelfSignature(cert *x509.Certificate) error {
+	pub, ok := cert.PublicKey.(*dsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate public key is %T, not a DSA key", cert.PublicKey)
+	}
+
+	var sig dsaSignature
+	if _, err := asn1.Unmarshal(cert.Signature, &sig); err != nil {
+		return fmt.Errorf("invalid DSA signature encoding: %v", err)
+	}
+
+	digest := sha1.Sum(cert.RawTBSCertificate)
+	if !dsa.Verify(pub, digest[:], sig.R, sig.S) {
+		return fmt.Errorf("DSA signature verification failed")
+	}
+	return nil
+}
+
+// decodePKCS7Response formats and decodes a stripped PKCS7 document.
+func decodePKCS7Response(resp []byte) (*pkcs7.PKCS7, error) {
+	p7Pem := fmt.Sprintf("-----BEGIN PKCS7-----\n%s\n-----END PKCS7-----", resp)
+	block, _ := pem.Decode([]byte(p7Pem))
+	if block == nil {
+		return nil, fmt.Errorf("could not decode PEM block")
+	}
+	if block.Type != "PKCS7" {
+		return nil, fmt.Errorf("could not decode PEM block type %s", block.Type)
+	}
+
+	p7, err := pkcs7.Parse(block.Bytes)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	return p7, nil
+}
+
+// pkcs7SignedAttribute mirrors the unexported attribute type in
+// go.mozilla.org/pkcs7, so a SignerInfo's authenticated attributes can be
+// re-encoded the same way it signed them.
+type pkcs7SignedAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+// verifyDSASignerInfos checks every SignerInfo in sig against its single
+// registered certificate using DSA-SHA1, the format AWS's default pkcs7
+// endpoint uses. sig.Verify would do this, but it delegates to
+// (*x509.Certificate).CheckSignature, which does not support DSA.
+func verifyDSASignerInfos(sig *pkcs7.PKCS7) error {
+	cert := sig.Certificates[0]
+	pub, ok := cert.PublicKey.(*dsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate public key is %T, not a DSA key", cert.PublicKey)
+	}
+	if len(sig.Signers) == 0 {
+		return fmt.Errorf("pkcs7: message has no signers")
+	}
+
+	for _, signer := range sig.Signers {
+		signedData := sig.Content
+
+		if len(signer.AuthenticatedAttributes) > 0 {
+			var digest []byte
+			found := false
+			for _, attr := range signer.AuthenticatedAttributes {
+				if !attr.Type.Equal(pkcs7.OIDAttributeMessageDigest) {
+					continue
+				}
+				if _, err := asn1.Unmarshal(attr.Value.Bytes, &digest); err != nil {
+					return fmt.Errorf("invalid message digest attribute: %v", err)
+				}
+				found = true
+				break
+			}
+			if !found {
+				return fmt.Errorf("signed attributes are missing a message digest")
+			}
+			sum := sha1.Sum(sig.Content)
+			if subtle.ConstantTimeCompare(digest, sum[:]) != 1 {
+				return fmt.Errorf("message digest mismatch")
+			}
+
+			var attrs []pkcs7SignedAttribute
+			for _, attr := range signer.AuthenticatedAttributes {
+				attrs = append(attrs, pkcs7SignedAttribute{Type: attr.Type, Value: attr.Value})
+			}
+			encoded, err := asn1.Marshal(struct {
+				A []pkcs7SignedAttribute `asn1:"set"`
+			}{A: attrs})
+			if err != nil {
+				return fmt.Errorf("could not re-encode signed attributes: %v", err)
+			}
+			var raw asn1.RawValue
+			if _, err := asn1.Unmarshal(encoded, &raw); err != nil {
+				return fmt.Errorf("could not re-encode signed attributes: %v", err)
+			}
+			signedData = raw.Bytes
+		}
+
+		var dsaSig dsaSignature
+		if _, err := asn1.Unmarshal(signer.EncryptedDigest, &dsaSig); err != nil {
+			return fmt.Errorf("invalid DSA signature encoding: %v", err)
+		}
+		digest := sha1.Sum(signedData)
+		if !dsa.Verify(pub, digest[:], dsaSig.R, dsaSig.S) {
+			return fmt.Errorf("DSA signature verification failed")
+		}
 	}
 
-	// success!
-	fmt.Printf("%s\n", sig.Content)
+	return nil
 }
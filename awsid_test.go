@@ -1,9 +1,25 @@
-package main
+package awsid
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
 )
 
 var slackCertPem = `-----BEGIN CERTIFICATE-----
@@ -47,40 +63,409 @@ func TestCertificateParse(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not validate Amazon cert: %v\n", err)
 	}
+
+	if _, err := decodeCertificate([]byte("not a PEM block")); err == nil {
+		t.Fatalf("decoded a certificate from data with no PEM block")
+	}
 }
 
-func TestPKCS7Verify(t *testing.T) {
-	// load the Amazon certificate
-	cert, err := decodeCertificate([]byte(amazonCertPem))
+func TestVerifierVerifyPKCS7(t *testing.T) {
+	v, err := NewVerifier()
 	if err != nil {
-		t.Fatalf("could not decode Amazon cert: %v\n", err)
+		t.Fatalf("could not build verifier: %v", err)
 	}
 
-	// decode the test signature
 	pkcs7Bytes, err := ioutil.ReadFile("testdata/pkcs7")
 	if err != nil {
 		t.Fatal(err)
 	}
-	sig, err := decodePKCS7Response(pkcs7Bytes)
+
+	doc, err := v.VerifyPKCS7(pkcs7Bytes)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// No matter what was in the PKCS7 blob, we only use the supplied certificate.
-	sig.Certificates = []*x509.Certificate{cert}
+	if doc.Region != "us-east-1" {
+		t.Fatalf("got region %q, want us-east-1", doc.Region)
+	}
+	if doc.InstanceID != "i-f79fe56c" {
+		t.Fatalf("got instance ID %q, want i-f79fe56c", doc.InstanceID)
+	}
+
+	_, wrongCertPem := selfSignedRSACert(t)
+	badStore := NewCertificateStore()
+	if err := badStore.Register(doc.Region, SigAlgoDSASHA1, wrongCertPem); err != nil {
+		t.Fatalf("could not register test certificate: %v", err)
+	}
+	v.Certs = badStore
+	if _, err := v.VerifyPKCS7(pkcs7Bytes); err == nil {
+		t.Fatal("validated a signature with the wrong cert")
+	}
+}
+
+func TestCertificateStoreFailsClosed(t *testing.T) {
+	s := NewCertificateStore()
+
+	if _, ok := s.Lookup("mars-central-1", SigAlgoDSASHA1); ok {
+		t.Fatalf("looked up a certificate for a region that was never registered")
+	}
+
+	if err := s.Register("us-gov-west-1", SigAlgoDSASHA1, []byte(amazonCertPem)); err != nil {
+		t.Fatalf("could not register region certificate: %v", err)
+	}
+
+	if _, ok := s.Lookup("us-gov-west-1", SigAlgoDSASHA1); !ok {
+		t.Fatalf("did not find certificate after registering it")
+	}
+}
+
+func TestSignatureFormatSigAlgo(t *testing.T) {
+	cases := []struct {
+		format SignatureFormat
+		want   SigAlgo
+	}{
+		{FormatPKCS7DSA, SigAlgoDSASHA1},
+		{FormatPKCS7RSA2048, SigAlgoRSA2048SHA256},
+		{FormatDetachedRSA2048, SigAlgoRSA2048SHA256},
+	}
+	for _, c := range cases {
+		if got := c.format.sigAlgo(); got != c.want {
+			t.Errorf("SignatureFormat(%d).sigAlgo() = %v, want %v", c.format, got, c.want)
+		}
+	}
+}
+
+// selfSignedRSACert generates a throwaway self-signed RSA-2048 cert and key
+// for exercising the detached-signature path without a real AWS fixture.
+func selfSignedRSACert(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate RSA key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "awsid-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create test certificate: %v", err)
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestVerifierFetchIMDSv2(t *testing.T) {
+	key, certPem := selfSignedRSACert(t)
+
+	doc := IdentityDocument{Region: "us-east-1", AccountID: "123456789012"}
+	docBytes, sigBytes := signDocument(t, key, doc)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == tokenPath:
+			if got := r.Header.Get(tokenTTLHeader); got != "21600" {
+				t.Errorf("token request ttl header = %q, want 21600", got)
+			}
+			w.Write([]byte("test-token"))
+		case r.Method == http.MethodGet && r.URL.Path == documentPath:
+			if got := r.Header.Get(tokenHeader); got != "test-token" {
+				t.Errorf("document request token header = %q, want test-token", got)
+			}
+			w.Write(docBytes)
+		case r.Method == http.MethodGet && r.URL.Path == signaturePath:
+			if got := r.Header.Get(tokenHeader); got != "test-token" {
+				t.Errorf("signature request token header = %q, want test-token", got)
+			}
+			w.Write([]byte(base64.StdEncoding.EncodeToString(sigBytes)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	store := NewCertificateStore()
+	if err := store.Register(doc.Region, SigAlgoRSA2048SHA256, certPem); err != nil {
+		t.Fatalf("could not register test certificate: %v", err)
+	}
+
+	v := &Verifier{
+		Certs:    store,
+		Format:   FormatDetachedRSA2048,
+		BaseURL:  srv.URL,
+		IMDSMode: IMDSV2Only,
+	}
+
+	got, err := v.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if got.Region != doc.Region || got.AccountID != doc.AccountID {
+		t.Errorf("Fetch returned %+v, want %+v", got, doc)
+	}
+}
+
+// signDocument signs doc with key as if it were a detached RSA-2048/SHA-256
+// identity document signature, standing in for a replayed AWS fixture.
+func signDocument(t *testing.T, key *rsa.PrivateKey, doc IdentityDocument) ([]byte, []byte) {
+	t.Helper()
+
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("could not marshal test document: %v", err)
+	}
+	hashed := sha256.Sum256(docBytes)
+	sigBytes, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("could not sign test document: %v", err)
+	}
+	return docBytes, sigBytes
+}
+
+func TestVerifierPolicyMatrix(t *testing.T) {
+	key, certPem := selfSignedRSACert(t)
+
+	regions := []string{"us-east-1", "eu-west-1", "ap-southeast-2"}
+	store := NewCertificateStore()
+	for _, region := range regions {
+		if err := store.Register(region, SigAlgoRSA2048SHA256, certPem); err != nil {
+			t.Fatalf("could not register test certificate for %s: %v", region, err)
+		}
+	}
 
-	err = sig.Verify()
+	ec2Fixture, err := ioutil.ReadFile("testdata/pkcs7")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// badCert, err := decodeCertificate([]byte(slackCertPem))
-	// if err != nil {
-	// 	t.Fatal(err)
-	// }
-	// sig.Certificates = []*x509.Certificate{badCert}
-	// err = sig.Verify()
-	// if err == nil {
-	// 	t.Fatal("validated a signature with wrong cert")
-	// }
+	cases := []struct {
+		name      string
+		doc       IdentityDocument
+		policy    *Policy
+		pkcs7     []byte // if set, verified via VerifyPKCS7 against the replayed EC2 fixture instead of doc
+		wantField string // empty means the document should pass
+	}{
+		{
+			name:   "pkcs7 path, allowed account",
+			pkcs7:  ec2Fixture,
+			policy: &Policy{AccountIDs: []string{"121659014334"}},
+		},
+		{
+			name:      "pkcs7 path, disallowed account",
+			pkcs7:     ec2Fixture,
+			policy:    &Policy{AccountIDs: []string{"999999999999"}},
+			wantField: "AccountID",
+		},
+		{
+			name:   "no policy",
+			doc:    IdentityDocument{Region: "us-east-1", AccountID: "111111111111"},
+			policy: nil,
+		},
+		{
+			name:   "allowed account",
+			doc:    IdentityDocument{Region: "us-east-1", AccountID: "111111111111"},
+			policy: &Policy{AccountIDs: []string{"111111111111", "222222222222"}},
+		},
+		{
+			name:      "disallowed account",
+			doc:       IdentityDocument{Region: "us-east-1", AccountID: "999999999999"},
+			policy:    &Policy{AccountIDs: []string{"111111111111"}},
+			wantField: "AccountID",
+		},
+		{
+			name:      "disallowed region",
+			doc:       IdentityDocument{Region: "ap-southeast-2", AccountID: "111111111111"},
+			policy:    &Policy{Regions: []string{"us-east-1", "eu-west-1"}},
+			wantField: "Region",
+		},
+		{
+			name:      "disallowed instance type",
+			doc:       IdentityDocument{Region: "us-east-1", InstanceType: "t2.nano"},
+			policy:    &Policy{InstanceTypes: []string{"m5.large"}},
+			wantField: "InstanceType",
+		},
+		{
+			name:      "disallowed image",
+			doc:       IdentityDocument{Region: "us-east-1", ImageID: "ami-bad"},
+			policy:    &Policy{ImageIDs: []string{"ami-good"}},
+			wantField: "ImageID",
+		},
+		{
+			name:      "denylisted instance",
+			doc:       IdentityDocument{Region: "us-east-1", InstanceID: "i-blocked"},
+			policy:    &Policy{InstanceIDDenylist: []string{"i-blocked"}},
+			wantField: "InstanceID",
+		},
+		{
+			name:      "instance not in allowlist",
+			doc:       IdentityDocument{Region: "us-east-1", InstanceID: "i-unknown"},
+			policy:    &Policy{InstanceIDAllowlist: []string{"i-expected"}},
+			wantField: "InstanceID",
+		},
+		{
+			name:      "stale pending time",
+			doc:       IdentityDocument{Region: "eu-west-1", PendingTime: time.Now().Add(-time.Hour)},
+			policy:    &Policy{MaxPendingAge: 5 * time.Minute},
+			wantField: "PendingTime",
+		},
+		{
+			name:   "fresh pending time",
+			doc:    IdentityDocument{Region: "eu-west-1", PendingTime: time.Now()},
+			policy: &Policy{MaxPendingAge: 5 * time.Minute},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var err error
+			if c.pkcs7 != nil {
+				v := &Verifier{Certs: NewCertificateStore(), Format: FormatPKCS7DSA, Policy: c.policy}
+				_, err = v.VerifyPKCS7(c.pkcs7)
+			} else {
+				docBytes, sigBytes := signDocument(t, key, c.doc)
+				encodedSig := []byte(base64.StdEncoding.EncodeToString(sigBytes))
+
+				v := &Verifier{Certs: store, Format: FormatDetachedRSA2048, Policy: c.policy}
+				_, err = v.VerifyDetachedRSA2048(docBytes, encodedSig)
+			}
+
+			if c.wantField == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+
+			var perr *PolicyError
+			if !errors.As(err, &perr) {
+				t.Fatalf("verify err = %v, want *PolicyError", err)
+			}
+			if perr.Field != c.wantField {
+				t.Errorf("PolicyError.Field = %q, want %q", perr.Field, c.wantField)
+			}
+		})
+	}
+}
+
+// toIndefiniteBER rewrites a single top-level DER TLV to use BER
+// indefinite-length encoding, the quirk real AWS pkcs7 responses exercise
+// and that strict DER parsers reject.
+func toIndefiniteBER(t *testing.T, der []byte) []byte {
+	t.Helper()
+
+	tag := der[0]
+	i := 1
+	first := der[i]
+	i++
+	var contentLen int
+	if first&0x80 == 0 {
+		contentLen = int(first)
+	} else {
+		for n := int(first & 0x7f); n > 0; n-- {
+			contentLen = contentLen<<8 | int(der[i])
+			i++
+		}
+	}
+	if i+contentLen != len(der) {
+		t.Fatalf("toIndefiniteBER: der has trailing bytes beyond the top-level TLV")
+	}
+
+	out := append([]byte{tag, 0x80}, der[i:]...)
+	return append(out, 0x00, 0x00)
+}
+
+func TestDecodePKCS7ResponseToleratesIndefiniteLengthBER(t *testing.T) {
+	key, certPem := selfSignedRSACert(t)
+	cert, err := decodeCertificate(certPem)
+	if err != nil {
+		t.Fatalf("could not decode test certificate: %v", err)
+	}
+
+	content := []byte(`{"region":"us-east-1"}`)
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		t.Fatalf("could not build test SignedData: %v", err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("could not sign test SignedData: %v", err)
+	}
+	der, err := sd.Finish()
+	if err != nil {
+		t.Fatalf("could not finish test SignedData: %v", err)
+	}
+
+	ber := toIndefiniteBER(t, der)
+	resp := []byte(base64.StdEncoding.EncodeToString(ber))
+
+	sig, err := decodePKCS7Response(resp)
+	if err != nil {
+		t.Fatalf("decodePKCS7Response rejected indefinite-length BER: %v", err)
+	}
+
+	sig.Certificates = []*x509.Certificate{cert}
+	if err := sig.Verify(); err != nil {
+		t.Fatalf("could not verify indefinite-length BER signature: %v", err)
+	}
+	if string(sig.Content) != string(content) {
+		t.Errorf("sig.Content = %q, want %q", sig.Content, content)
+	}
+}
+
+func TestVerifyPKCS7RejectsMalformedBlob(t *testing.T) {
+	v, err := NewVerifier()
+	if err != nil {
+		t.Fatalf("could not build verifier: %v", err)
+	}
+
+	if _, err := v.VerifyPKCS7([]byte("not valid base64 !!!")); err == nil {
+		t.Fatal("verified a malformed PKCS7 blob")
+	}
+}
+
+func TestVerifierVerifyPKCS7RSA2048(t *testing.T) {
+	key, certPem := selfSignedRSACert(t)
+	cert, err := decodeCertificate(certPem)
+	if err != nil {
+		t.Fatalf("could not decode test certificate: %v", err)
+	}
+
+	doc := IdentityDocument{Region: "us-east-1", AccountID: "123456789012"}
+	content, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("could not marshal test document: %v", err)
+	}
+
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		t.Fatalf("could not build test SignedData: %v", err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("could not sign test SignedData: %v", err)
+	}
+	der, err := sd.Finish()
+	if err != nil {
+		t.Fatalf("could not finish test SignedData: %v", err)
+	}
+	resp := []byte(base64.StdEncoding.EncodeToString(der))
+
+	store := NewCertificateStore()
+	if err := store.Register(doc.Region, SigAlgoRSA2048SHA256, certPem); err != nil {
+		t.Fatalf("could not register test certificate: %v", err)
+	}
+
+	v := &Verifier{Certs: store, Format: FormatPKCS7RSA2048}
+	got, err := v.VerifyPKCS7(resp)
+	if err != nil {
+		t.Fatalf("VerifyPKCS7: %v", err)
+	}
+	if got.Region != doc.Region || got.AccountID != doc.AccountID {
+		t.Errorf("VerifyPKCS7 returned %+v, want %+v", got, doc)
+	}
 }
@@ -0,0 +1,30 @@
+// Command awsid retrieves and verifies the instance identity document for
+// the EC2 instance it is run on, printing the parsed document as JSON.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/gtank/awsid"
+)
+
+func main() {
+	v, err := awsid.NewVerifier()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	doc, err := v.Fetch(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+}